@@ -0,0 +1,318 @@
+// Copyright 2018 Ian Johnson
+//
+// This file is part of wallpaper.
+//
+// Wallpaper is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Wallpaper is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Wallpaper. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// filterStage is one parsed stage of a -filter pipeline, such as
+// "gaussian:2.5".
+type filterStage struct {
+	name string
+	arg  float64
+}
+
+// parseFilters parses a comma-separated -filter pipeline, such as
+// "gaussian:2.5,gamma:1.8,vignette:0.4", into its stages.
+func parseFilters(spec string) ([]filterStage, error) {
+	var stages []filterStage
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, argStr, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("filter %q: expected name:argument", part)
+		}
+		switch name {
+		case "gaussian", "sharpen", "gamma", "vignette":
+		default:
+			return nil, fmt.Errorf("filter %q: unknown filter", name)
+		}
+		arg, err := strconv.ParseFloat(argStr, 64)
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %v", part, err)
+		}
+		if name == "gaussian" && arg <= 0 {
+			return nil, fmt.Errorf("filter %q: sigma must be positive", part)
+		}
+		stages = append(stages, filterStage{name: name, arg: arg})
+	}
+	return stages, nil
+}
+
+// applyFilters runs each stage of the pipeline over rgba in order, returning
+// the filtered image.
+func applyFilters(rgba *image.RGBA, stages []filterStage) *image.RGBA {
+	for _, s := range stages {
+		switch s.name {
+		case "gaussian":
+			rgba = newFloatImage(rgba).gaussianBlur(s.arg).toRGBA()
+		case "sharpen":
+			f := newFloatImage(rgba)
+			blurred := f.gaussianBlur(2)
+			rgba = f.unsharpMask(blurred, s.arg).toRGBA()
+		case "gamma":
+			rgba = applyGamma(rgba, s.arg)
+		case "vignette":
+			rgba = applyVignette(rgba, s.arg)
+		}
+	}
+	return rgba
+}
+
+// renderTile is a disjoint horizontal strip of rows dispatched to a
+// renderToRGBA worker.
+type renderTile struct {
+	y0, y1 int
+}
+
+// renderToRGBA materializes img into an *image.RGBA. The image is split
+// into horizontal tiles of about 64 rows, which are dispatched over a
+// channel to a pool of *jobs worker goroutines; since each tile owns a
+// disjoint range of out.Pix, no locking is needed. This means img.At (and
+// whatever gradation and color computation a wallpaper wraps it in) runs
+// exactly once per pixel, in parallel, rather than serially once per
+// pixel per encoding/filtering pass.
+func renderToRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	out := image.NewRGBA(bounds)
+
+	const tileHeight = 64
+	var tiles []renderTile
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += tileHeight {
+		y1 := y + tileHeight
+		if y1 > bounds.Max.Y {
+			y1 = bounds.Max.Y
+		}
+		tiles = append(tiles, renderTile{y, y1})
+	}
+
+	workers := *jobs
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(tiles) {
+		workers = len(tiles)
+	}
+
+	tileCh := make(chan renderTile)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tileCh {
+				for y := t.y0; y < t.y1; y++ {
+					for x := bounds.Min.X; x < bounds.Max.X; x++ {
+						out.Set(x, y, img.At(x, y))
+					}
+				}
+			}
+		}()
+	}
+	for _, t := range tiles {
+		tileCh <- t
+	}
+	close(tileCh)
+	wg.Wait()
+
+	return out
+}
+
+// floatImage is a mutable R, G, B buffer of unclamped float64 values (on
+// the usual 0 to 255 scale), used while applying filters so that several
+// passes in a row don't accumulate 8-bit rounding error.
+type floatImage struct {
+	w, h int
+	pix  []float64 // w*h*3, row-major, R G B
+}
+
+// newFloatImage copies img into a floatImage.
+func newFloatImage(img *image.RGBA) *floatImage {
+	bounds := img.Bounds()
+	f := &floatImage{w: bounds.Dx(), h: bounds.Dy(), pix: make([]float64, bounds.Dx()*bounds.Dy()*3)}
+	for y := 0; y < f.h; y++ {
+		for x := 0; x < f.w; x++ {
+			c := img.RGBAAt(bounds.Min.X+x, bounds.Min.Y+y)
+			f.set(x, y, float64(c.R), float64(c.G), float64(c.B))
+		}
+	}
+	return f
+}
+
+// at returns the R, G, B value at (x, y), clamping the coordinates to the
+// buffer's bounds.
+func (f *floatImage) at(x, y int) (r, g, b float64) {
+	x = clampInt(x, 0, f.w-1)
+	y = clampInt(y, 0, f.h-1)
+	i := (y*f.w + x) * 3
+	return f.pix[i], f.pix[i+1], f.pix[i+2]
+}
+
+func (f *floatImage) set(x, y int, r, g, b float64) {
+	i := (y*f.w + x) * 3
+	f.pix[i], f.pix[i+1], f.pix[i+2] = r, g, b
+}
+
+// toRGBA converts f back into an *image.RGBA, clamping each channel to the
+// 0-255 range.
+func (f *floatImage) toRGBA() *image.RGBA {
+	out := image.NewRGBA(image.Rect(0, 0, f.w, f.h))
+	for y := 0; y < f.h; y++ {
+		for x := 0; x < f.w; x++ {
+			r, g, b := f.at(x, y)
+			out.SetRGBA(x, y, color.RGBA{clampByte(r), clampByte(g), clampByte(b), 255})
+		}
+	}
+	return out
+}
+
+// gaussianBlur returns a new floatImage blurred by a Gaussian kernel with
+// the given standard deviation, applying a separable 1-D kernel
+// horizontally and then vertically rather than a full 2-D convolution.
+func (f *floatImage) gaussianBlur(sigma float64) *floatImage {
+	kernel := gaussianKernel(sigma)
+	radius := len(kernel) / 2
+
+	horiz := &floatImage{w: f.w, h: f.h, pix: make([]float64, len(f.pix))}
+	for y := 0; y < f.h; y++ {
+		for x := 0; x < f.w; x++ {
+			var r, g, b float64
+			for k := -radius; k <= radius; k++ {
+				wt := kernel[k+radius]
+				sr, sg, sb := f.at(x+k, y)
+				r += wt * sr
+				g += wt * sg
+				b += wt * sb
+			}
+			horiz.set(x, y, r, g, b)
+		}
+	}
+
+	out := &floatImage{w: f.w, h: f.h, pix: make([]float64, len(f.pix))}
+	for y := 0; y < f.h; y++ {
+		for x := 0; x < f.w; x++ {
+			var r, g, b float64
+			for k := -radius; k <= radius; k++ {
+				wt := kernel[k+radius]
+				sr, sg, sb := horiz.at(x, y+k)
+				r += wt * sr
+				g += wt * sg
+				b += wt * sb
+			}
+			out.set(x, y, r, g, b)
+		}
+	}
+	return out
+}
+
+// gaussianKernel returns a normalized 1-D Gaussian kernel with radius
+// ceil(3*sigma).
+func gaussianKernel(sigma float64) []float64 {
+	radius := int(math.Ceil(3 * sigma))
+	if radius < 1 {
+		radius = 1
+	}
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := -radius; i <= radius; i++ {
+		v := math.Exp(-float64(i*i) / (2 * sigma * sigma))
+		kernel[i+radius] = v
+		sum += v
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// unsharpMask returns a new floatImage sharpened by adding back the detail
+// that blurred (a blurred copy of f) removed, scaled by amount.
+func (f *floatImage) unsharpMask(blurred *floatImage, amount float64) *floatImage {
+	out := &floatImage{w: f.w, h: f.h, pix: make([]float64, len(f.pix))}
+	for i := range f.pix {
+		out.pix[i] = f.pix[i] + amount*(f.pix[i]-blurred.pix[i])
+	}
+	return out
+}
+
+// applyGamma applies out = pow(c/255, 1/gamma)*255 to every channel of img.
+func applyGamma(img *image.RGBA, gamma float64) *image.RGBA {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			img.SetRGBA(x, y, color.RGBA{
+				gammaByte(c.R, gamma),
+				gammaByte(c.G, gamma),
+				gammaByte(c.B, gamma),
+				c.A,
+			})
+		}
+	}
+	return img
+}
+
+func gammaByte(c uint8, gamma float64) uint8 {
+	return clampByte(math.Pow(float64(c)/255, 1/gamma) * 255)
+}
+
+// applyVignette multiplies each pixel by 1 - strength*(r/rMax)^2, where r is
+// the pixel's distance from the image center, darkening the corners.
+func applyVignette(img *image.RGBA, strength float64) *image.RGBA {
+	bounds := img.Bounds()
+	cx := float64(bounds.Min.X+bounds.Max.X) / 2
+	cy := float64(bounds.Min.Y+bounds.Max.Y) / 2
+	rMax := math.Hypot(float64(bounds.Dx())/2, float64(bounds.Dy())/2)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r := math.Hypot(float64(x)-cx, float64(y)-cy)
+			factor := 1 - strength*(r/rMax)*(r/rMax)
+			c := img.RGBAAt(x, y)
+			img.SetRGBA(x, y, color.RGBA{
+				clampByte(float64(c.R) * factor),
+				clampByte(float64(c.G) * factor),
+				clampByte(float64(c.B) * factor),
+				c.A,
+			})
+		}
+	}
+	return img
+}
+
+// clampByte clamps v (on the usual 0 to 255 scale) to a valid byte value.
+func clampByte(v float64) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	default:
+		return uint8(v + 0.5)
+	}
+}
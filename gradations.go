@@ -21,10 +21,16 @@ import (
 	"flag"
 	"fmt"
 	"image"
+	"image/color"
 	_ "image/jpeg"
 	_ "image/png"
+	"math"
 	"math/cmplx"
+	"math/rand"
 	"os"
+	"strconv"
+
+	"github.com/rwcarlsen/goexif/exif"
 )
 
 // gradient returns a gradation function for a simple horizontal gradient given
@@ -65,16 +71,186 @@ func mandelbrot(w, h int, args []string) func(x, y int) float64 {
 	}
 }
 
+// julia returns a gradation function for the Julia set of the constant given
+// by the "-c" argument (e.g. "-c=-0.7+0.27015i"), scaled to fit within the
+// given width and height without changing its proportions.
+func julia(w, h int, args []string) func(x, y int) float64 {
+	flags := flag.NewFlagSet("julia", flag.ExitOnError)
+	iterations := flags.Int("i", 50, "set the number of iterations")
+	cFlag := flags.String("c", "-0.7+0.27015i", "set the Julia constant")
+	flags.Parse(args)
+
+	c, err := strconv.ParseComplex(*cFlag, 128)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "julia: invalid -c: %v\n", err)
+		os.Exit(2)
+	}
+
+	cx := float64(w / 2)
+	cy := float64(h / 2)
+	var r float64 // the radius of the containing disk around the origin (in px)
+	if h < w {
+		r = float64(h / 2)
+	} else {
+		r = float64(w / 2)
+	}
+
+	return func(x, y int) float64 {
+		z := complex(2*(float64(x)-cx)/r, 2*(float64(y)-cy)/r)
+		var i int
+		for i = 0; i < *iterations; i++ {
+			if cmplx.Abs(z) > 2 {
+				break
+			}
+			z = z*z + c
+		}
+		return float64(i) / float64(*iterations)
+	}
+}
+
+// perlinGradients holds the 8 unit-vector gradient directions used by the
+// perlin gradation.
+var perlinGradients = [8][2]float64{
+	{1, 1}, {-1, 1}, {1, -1}, {-1, -1},
+	{1, 0}, {-1, 0}, {0, 1}, {0, -1},
+}
+
+// perlin returns a gradation function producing classic 2-D Perlin noise,
+// optionally combining several octaves into fractal Brownian motion.
+func perlin(w, h int, args []string) func(x, y int) float64 {
+	flags := flag.NewFlagSet("perlin", flag.ExitOnError)
+	seed := flags.Int64("seed", -1, "set the random seed used to build the permutation table (default: random)")
+	scale := flags.Float64("scale", 0.01, "set the noise frequency")
+	octaves := flags.Int("octaves", 1, "set the number of octaves for fractal Brownian motion")
+	persistence := flags.Float64("persistence", 0.5, "set the amplitude falloff between octaves")
+	flags.Parse(args)
+
+	s := *seed
+	if s < 0 {
+		s = rand.Int63()
+	}
+	perm := newPermutation(s)
+
+	return func(x, y int) float64 {
+		var sum, amplitude, freq, maxValue float64
+		amplitude, freq = 1, 1
+		for o := 0; o < *octaves; o++ {
+			sum += amplitude * perlinNoise2D(perm, float64(x)*(*scale)*freq, float64(y)*(*scale)*freq)
+			maxValue += amplitude
+			amplitude *= *persistence
+			freq *= 2
+		}
+		// perlinNoise2D is in [-1, 1]; rescale to [0, 1].
+		return (sum/maxValue + 1) / 2
+	}
+}
+
+// newPermutation builds a 512-entry permutation table (the usual doubled
+// 0-255 permutation, so indices can overflow past 255 without wrapping
+// explicitly) seeded from the given value.
+func newPermutation(seed int64) [512]int {
+	r := rand.New(rand.NewSource(seed))
+	var p [256]int
+	for i := range p {
+		p[i] = i
+	}
+	r.Shuffle(len(p), func(i, j int) { p[i], p[j] = p[j], p[i] })
+
+	var perm [512]int
+	for i := range perm {
+		perm[i] = p[i%256]
+	}
+	return perm
+}
+
+// perlinNoise2D returns the value, in [-1, 1], of 2-D Perlin noise at (x,
+// y) using the given permutation table.
+func perlinNoise2D(perm [512]int, x, y float64) float64 {
+	xi := int(math.Floor(x)) & 255
+	yi := int(math.Floor(y)) & 255
+	xf := x - math.Floor(x)
+	yf := y - math.Floor(y)
+
+	u := fade(xf)
+	v := fade(yf)
+
+	g00 := perlinGradients[perm[perm[xi]+yi]%8]
+	g10 := perlinGradients[perm[perm[xi+1]+yi]%8]
+	g01 := perlinGradients[perm[perm[xi]+yi+1]%8]
+	g11 := perlinGradients[perm[perm[xi+1]+yi+1]%8]
+
+	d00 := g00[0]*xf + g00[1]*yf
+	d10 := g10[0]*(xf-1) + g10[1]*yf
+	d01 := g01[0]*xf + g01[1]*(yf-1)
+	d11 := g11[0]*(xf-1) + g11[1]*(yf-1)
+
+	return lerp(lerp(d00, d10, u), lerp(d01, d11, u), v)
+}
+
+// fade is Ken Perlin's smoothstep-like easing curve, 6t^5 - 15t^4 + 10t^3.
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6-15) + 10)
+}
+
+// lerp linearly interpolates between a and b by t.
+func lerp(a, b, t float64) float64 {
+	return a + t*(b-a)
+}
+
+// radial returns a gradation function giving the normalized distance of
+// each pixel from a center point (by default, the image's center).
+func radial(w, h int, args []string) func(x, y int) float64 {
+	flags := flag.NewFlagSet("radial", flag.ExitOnError)
+	cx := flags.Float64("cx", float64(w)/2, "set the center x coordinate")
+	cy := flags.Float64("cy", float64(h)/2, "set the center y coordinate")
+	flags.Parse(args)
+
+	maxRadius := 0.0
+	for _, corner := range [4][2]float64{{0, 0}, {float64(w), 0}, {0, float64(h)}, {float64(w), float64(h)}} {
+		if d := math.Hypot(corner[0]-*cx, corner[1]-*cy); d > maxRadius {
+			maxRadius = d
+		}
+	}
+
+	return func(x, y int) float64 {
+		d := math.Hypot(float64(x)-*cx, float64(y)-*cy)
+		return math.Min(1, d/maxRadius)
+	}
+}
+
+// spiral returns a gradation function tracing an Archimedean spiral out
+// from a center point (by default, the image's center).
+func spiral(w, h int, args []string) func(x, y int) float64 {
+	flags := flag.NewFlagSet("spiral", flag.ExitOnError)
+	k := flags.Float64("k", 1, "set the number of spiral arms")
+	period := flags.Float64("period", 100, "set the radial period of the spiral, in pixels")
+	cx := flags.Float64("cx", float64(w)/2, "set the center x coordinate")
+	cy := flags.Float64("cy", float64(h)/2, "set the center y coordinate")
+	flags.Parse(args)
+
+	return func(x, y int) float64 {
+		dx, dy := float64(x)-*cx, float64(y)-*cy
+		theta := math.Atan2(dy, dx)
+		r := math.Hypot(dx, dy)
+		v := *k*theta + r/(*period)
+		return v - math.Floor(v)
+	}
+}
+
 // graphic returns a gradation function based on the image whose filepath is
 // given as an argument. The gradation is based on the grayscale conversion of
 // the image.
 func graphic(w, h int, args []string) func(x, y int) float64 {
-	if len(args) != 1 {
-		fmt.Fprintln(os.Stderr, "usage: graphic <filepath>")
+	flags := flag.NewFlagSet("graphic", flag.ExitOnError)
+	interp := flags.String("interp", "nearest", "set the sampling method (nearest, bilinear, bicubic, lanczos3)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: graphic [-interp method] <filepath>")
 		os.Exit(2)
 	}
 
-	img, err := loadGrayImage(args[0])
+	img, err := loadGrayImage(flags.Arg(0))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "graphic: %v\n", err)
 		os.Exit(2)
@@ -90,18 +266,208 @@ func graphic(w, h int, args []string) func(x, y int) float64 {
 		sx = sy
 	}
 
+	// If we're downscaling on both axes, pre-filter the image with a box
+	// filter so high frequencies above the output's Nyquist rate don't
+	// alias; otherwise a single stray bright source pixel can show up as
+	// noise in the (much smaller) output.
+	if sx < 1 && sy < 1 {
+		img = boxFilter(img, sx, sy)
+		sx = float64(w) / float64(img.Bounds().Dx())
+		sy = float64(h) / float64(img.Bounds().Dy())
+	}
+
+	sample := sampler(*interp, img)
+	minX, minY := float64(img.Bounds().Min.X), float64(img.Bounds().Min.Y)
+
 	return func(x, y int) float64 {
 		// Calculate the "projected" x and y onto the original image.
-		px := float64(x)/sx + float64(img.Bounds().Min.X)
-		py := float64(y)/sy + float64(img.Bounds().Min.Y)
-		// TODO: use some sort of interpolation instead of "nearest
-		// neighbor".
-		c := img.GrayAt(int(px), int(py))
-		return float64(c.Y) / 255
+		px := float64(x)/sx + minX
+		py := float64(y)/sy + minY
+		return sample(px, py)
+	}
+}
+
+// sampler returns a function that samples img at a (possibly fractional)
+// coordinate using the named interpolation method, clamping at the image's
+// edges.
+func sampler(interp string, img *image.Gray) func(px, py float64) float64 {
+	switch interp {
+	case "bilinear":
+		return bilinearSample(img)
+	case "bicubic":
+		return convolveSample(img, catmullRom, 2)
+	case "lanczos3":
+		return convolveSample(img, lanczos3, 3)
+	default:
+		return nearestSample(img)
+	}
+}
+
+// grayAt returns the normalized (0 to 1) gray value of img at (x, y),
+// clamping the coordinates to the image's bounds.
+func grayAt(img *image.Gray, x, y int) float64 {
+	b := img.Bounds()
+	if x < b.Min.X {
+		x = b.Min.X
+	} else if x >= b.Max.X {
+		x = b.Max.X - 1
+	}
+	if y < b.Min.Y {
+		y = b.Min.Y
+	} else if y >= b.Max.Y {
+		y = b.Max.Y - 1
 	}
+	return float64(img.GrayAt(x, y).Y) / 255
+}
+
+// nearestSample returns a sampler that rounds down to the nearest pixel.
+func nearestSample(img *image.Gray) func(px, py float64) float64 {
+	return func(px, py float64) float64 {
+		return grayAt(img, int(px), int(py))
+	}
+}
+
+// bilinearSample returns a sampler that linearly interpolates between the
+// four pixels surrounding (px, py), weighted by their fractional offsets.
+func bilinearSample(img *image.Gray) func(px, py float64) float64 {
+	return func(px, py float64) float64 {
+		x0 := math.Floor(px)
+		y0 := math.Floor(py)
+		fx, fy := px-x0, py-y0
+		x, y := int(x0), int(y0)
+
+		top := grayAt(img, x, y) + (grayAt(img, x+1, y)-grayAt(img, x, y))*fx
+		bottom := grayAt(img, x, y+1) + (grayAt(img, x+1, y+1)-grayAt(img, x, y+1))*fx
+		return top + (bottom-top)*fy
+	}
+}
+
+// catmullRom is the Catmull-Rom cubic convolution kernel used for bicubic
+// sampling.
+func catmullRom(t float64) float64 {
+	t = math.Abs(t)
+	switch {
+	case t < 1:
+		return 1.5*t*t*t - 2.5*t*t + 1
+	case t < 2:
+		return -0.5*t*t*t + 2.5*t*t - 4*t + 2
+	default:
+		return 0
+	}
+}
+
+// lanczos3 is the Lanczos kernel with a = 3, used for Lanczos-3 sampling.
+func lanczos3(t float64) float64 {
+	if t == 0 {
+		return 1
+	}
+	if t <= -3 || t >= 3 {
+		return 0
+	}
+	pit := math.Pi * t
+	return 3 * math.Sin(pit) * math.Sin(pit/3) / (pit * pit)
+}
+
+// convolveSample returns a sampler that evaluates the given separable kernel
+// over a (2*radius)-wide neighborhood around each sample point, normalizing
+// the weights so the result stays within the source's value range.
+func convolveSample(img *image.Gray, kernel func(float64) float64, radius int) func(px, py float64) float64 {
+	return func(px, py float64) float64 {
+		x0 := int(math.Floor(px))
+		y0 := int(math.Floor(py))
+
+		var sum, weightSum float64
+		for j := -radius + 1; j <= radius; j++ {
+			wy := kernel(py - float64(y0+j))
+			for i := -radius + 1; i <= radius; i++ {
+				weight := kernel(px-float64(x0+i)) * wy
+				sum += weight * grayAt(img, x0+i, y0+j)
+				weightSum += weight
+			}
+		}
+		if weightSum == 0 {
+			return grayAt(img, x0, y0)
+		}
+		return sum / weightSum
+	}
+}
+
+// boxFilter returns a downscaled copy of img, sized so that applying scale
+// factors sx and sy to it lands close to 1:1, using a summed-area table to
+// average each output pixel over the source pixels it covers.
+func boxFilter(img *image.Gray, sx, sy float64) *image.Gray {
+	b := img.Bounds()
+	nw := int(math.Ceil(float64(b.Dx()) * sx))
+	nh := int(math.Ceil(float64(b.Dy()) * sy))
+	if nw < 1 {
+		nw = 1
+	}
+	if nh < 1 {
+		nh = 1
+	}
+
+	sat := newSummedAreaTable(img)
+	out := image.NewGray(image.Rect(0, 0, nw, nh))
+	for y := 0; y < nh; y++ {
+		sy0 := float64(y) / sy
+		sy1 := float64(y+1) / sy
+		for x := 0; x < nw; x++ {
+			sx0 := float64(x) / sx
+			sx1 := float64(x+1) / sx
+			area := (sx1 - sx0) * (sy1 - sy0)
+			sum := sat.boxSum(int(math.Round(sx0)), int(math.Round(sy0)), int(math.Round(sx1)), int(math.Round(sy1)))
+			out.SetGray(x, y, color.Gray{Y: uint8(sum / area)})
+		}
+	}
+	return out
+}
+
+// summedAreaTable is an integral image over a *image.Gray's values, used to
+// compute the sum of any axis-aligned rectangle of pixels in O(1).
+type summedAreaTable struct {
+	w, h int
+	sum  []float64 // (w+1) x (h+1); sum[y*(w+1)+x] covers [0,x) x [0,y)
+}
+
+func newSummedAreaTable(img *image.Gray) *summedAreaTable {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	sat := &summedAreaTable{w: w, h: h, sum: make([]float64, (w+1)*(h+1))}
+	stride := w + 1
+	for y := 0; y < h; y++ {
+		var rowSum float64
+		for x := 0; x < w; x++ {
+			rowSum += float64(img.GrayAt(b.Min.X+x, b.Min.Y+y).Y)
+			sat.sum[(y+1)*stride+x+1] = sat.sum[y*stride+x+1] + rowSum
+		}
+	}
+	return sat
+}
+
+// boxSum returns the sum of pixel values in [x0, x1) x [y0, y1), clamping
+// the rectangle to the table's bounds.
+func (sat *summedAreaTable) boxSum(x0, y0, x1, y1 int) float64 {
+	x0, x1 = clampInt(x0, 0, sat.w), clampInt(x1, 0, sat.w)
+	y0, y1 = clampInt(y0, 0, sat.h), clampInt(y1, 0, sat.h)
+	stride := sat.w + 1
+	return sat.sum[y1*stride+x1] - sat.sum[y0*stride+x1] - sat.sum[y1*stride+x0] + sat.sum[y0*stride+x0]
+}
+
+// clampInt clamps v to the range [lo, hi].
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
 }
 
 // loadGrayImage loads the image at the given filepath as a grayscale image.
+// If the file is a JPEG carrying an EXIF Orientation tag, the image is
+// transposed and/or flipped to its upright orientation, so photos taken on
+// phones don't come out sideways when used as graphic inputs.
 func loadGrayImage(filepath string) (*image.Gray, error) {
 	in, err := os.Open(filepath)
 	if err != nil {
@@ -120,5 +486,143 @@ func loadGrayImage(filepath string) (*image.Gray, error) {
 			gray.Set(x, y, img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y))
 		}
 	}
+
+	if orientation, err := readOrientation(filepath); err == nil {
+		gray = applyOrientation(gray, orientation)
+	}
+
 	return gray, nil
 }
+
+// readOrientation reads the EXIF Orientation tag (1-8) from the file at
+// filepath. It returns an error if the file has no EXIF metadata (as is the
+// case for any non-JPEG input), which callers should treat as "no rotation
+// needed".
+func readOrientation(filepath string) (int, error) {
+	in, err := os.Open(filepath)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	x, err := exif.Decode(in)
+	if err != nil {
+		return 0, err
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 0, err
+	}
+	return tag.Int(0)
+}
+
+// applyOrientation transposes and/or flips gray according to the given EXIF
+// Orientation value (1-8), returning the corrected image. Orientation
+// values that swap the image's aspect ratio (5-8) are handled on the gray
+// buffer directly, so this works the same regardless of the original
+// source format.
+func applyOrientation(gray *image.Gray, orientation int) *image.Gray {
+	switch orientation {
+	case 2:
+		return flipHorizontal(gray)
+	case 3:
+		return rotate180(gray)
+	case 4:
+		return flipVertical(gray)
+	case 5:
+		return transpose(gray)
+	case 6:
+		return rotate90CW(gray)
+	case 7:
+		return transverse(gray)
+	case 8:
+		return rotate270CW(gray)
+	default:
+		return gray
+	}
+}
+
+func flipHorizontal(g *image.Gray) *image.Gray {
+	b := g.Bounds()
+	out := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.SetGray(b.Dx()-1-x, y, g.GrayAt(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+func flipVertical(g *image.Gray) *image.Gray {
+	b := g.Bounds()
+	out := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.SetGray(x, b.Dy()-1-y, g.GrayAt(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+func rotate180(g *image.Gray) *image.Gray {
+	b := g.Bounds()
+	out := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.SetGray(b.Dx()-1-x, b.Dy()-1-y, g.GrayAt(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// transpose mirrors the image across its top-left to bottom-right diagonal,
+// swapping width and height.
+func transpose(g *image.Gray) *image.Gray {
+	b := g.Bounds()
+	out := image.NewGray(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.SetGray(y, x, g.GrayAt(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// transverse mirrors the image across its top-right to bottom-left
+// diagonal, swapping width and height.
+func transverse(g *image.Gray) *image.Gray {
+	b := g.Bounds()
+	out := image.NewGray(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.SetGray(b.Dy()-1-y, b.Dx()-1-x, g.GrayAt(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// rotate90CW rotates the image 90 degrees clockwise, swapping width and
+// height.
+func rotate90CW(g *image.Gray) *image.Gray {
+	b := g.Bounds()
+	out := image.NewGray(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.SetGray(b.Dy()-1-y, x, g.GrayAt(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// rotate270CW rotates the image 270 degrees clockwise (90 degrees
+// counterclockwise), swapping width and height.
+func rotate270CW(g *image.Gray) *image.Gray {
+	b := g.Bounds()
+	out := image.NewGray(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.SetGray(y, b.Dx()-1-x, g.GrayAt(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
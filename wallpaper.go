@@ -23,24 +23,44 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
 	"io"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
 )
 
 var (
 	width, height *int
 	output        *string
 	discrete      *bool
+	quality       *int
+	colorspace    *string
+	metric        *string
+	filterSpec    *string
+	stops         *int
+	jobs          *int
 )
 
 var pictures = map[string]picture{
 	"gradient":   gradient,
 	"mandelbrot": mandelbrot,
+	"julia":      julia,
+	"perlin":     perlin,
+	"radial":     radial,
+	"spiral":     spiral,
 }
 
 func init() {
@@ -54,6 +74,12 @@ func init() {
 	height = flag.Int("h", defaultHeight, "set the height of the generated image")
 	output = flag.String("o", defaultOutput, "set the output file")
 	discrete = flag.Bool("d", false, "use only colors from the given list")
+	quality = flag.Int("q", 90, "set the quality to use when encoding JPEG output")
+	colorspace = flag.String("colorspace", "srgb", "set the colorspace used for interpolation (srgb, linear, oklab)")
+	metric = flag.String("metric", "rgb", "set the color distance metric used for -d (rgb, weighted, cielab)")
+	filterSpec = flag.String("filter", "", "apply a comma-separated pipeline of post-processing filters, e.g. \"gaussian:2.5,gamma:1.8,vignette:0.4\"")
+	stops = flag.Int("stops", 2, "set the number of colors to interpolate across (ignored with -d)")
+	jobs = flag.Int("j", runtime.GOMAXPROCS(0), "set the number of worker goroutines used to render the image")
 }
 
 func main() {
@@ -70,28 +96,50 @@ func main() {
 		os.Exit(2)
 	}
 
-	colors, err := readColors(os.Stdin)
+	entries, err := readColors(os.Stdin)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "wallpaper: could not read colors: %v\n", err)
 		os.Exit(1)
 	}
-	if len(colors) < 2 {
+	if len(entries) < 2 {
 		fmt.Fprintln(os.Stderr, "wallpaper: not enough colors")
 		os.Exit(1)
 	}
 
-	c1, c2 := chooseTwo(colors)
-	var color func(grad float64) color.Color
+	colors := make([]color.Color, len(entries))
+	for i, e := range entries {
+		colors[i] = e.color
+	}
+	palette := color.Palette(colors)
+
+	var colorFn func(grad float64) color.Color
 	if *discrete {
-		color = discreteColor(c1, c2, colors)
+		c1, c2 := chooseTwo(colors)
+		colorFn = discreteColor(c1, c2, colors)
 	} else {
-		color = continousColor(c1, c2)
+		colorFn = continousColor(chooseStops(entries, *stops))
 	}
 	img := wallpaper{
 		w:         *width,
 		h:         *height,
 		gradation: pic(*width, *height, flag.Args()[1:]),
-		color:     color,
+		color:     colorFn,
+	}
+
+	rendered := renderToRGBA(img)
+	var final image.Image = rendered
+	if *filterSpec != "" {
+		filters, err := parseFilters(*filterSpec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "wallpaper: invalid -filter: %v\n", err)
+			os.Exit(2)
+		}
+		final = applyFilters(rendered, filters)
+	}
+
+	ext := strings.ToLower(filepath.Ext(*output))
+	if *discrete && (ext == ".gif" || ext == ".png") {
+		final = palettedImage(final, palette)
 	}
 
 	out, err := os.Create(*output)
@@ -100,7 +148,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := png.Encode(out, img); err != nil {
+	if err := encodeImage(out, final, ext); err != nil {
 		out.Close()
 		fmt.Fprintf(os.Stderr, "wallpaper: could not write image: %v\n", err)
 		os.Exit(1)
@@ -112,6 +160,43 @@ func main() {
 	}
 }
 
+// encodeImage writes img to w, choosing the encoder based on ext (a
+// filename extension including the leading dot, as returned by
+// filepath.Ext). It returns an error if ext does not name a supported
+// format.
+func encodeImage(w io.Writer, img image.Image, ext string) error {
+	switch ext {
+	case ".png":
+		return png.Encode(w, img)
+	case ".jpg", ".jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: *quality})
+	case ".bmp":
+		return bmp.Encode(w, img)
+	case ".tif", ".tiff":
+		return tiff.Encode(w, img, nil)
+	case ".gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("unsupported output format %q", ext)
+	}
+}
+
+// palettedImage renders img into an *image.Paletted using the given
+// palette. This is used for discrete-mode output, where every pixel is
+// already one of a small set of colors, so storing a palette index per
+// pixel instead of a full RGBA value shrinks the encoded file
+// dramatically.
+func palettedImage(img image.Image, palette color.Palette) *image.Paletted {
+	bounds := img.Bounds()
+	p := image.NewPaletted(bounds, palette)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			p.Set(x, y, img.At(x, y))
+		}
+	}
+	return p
+}
+
 // picture is a function that, given the width and height of the desired
 // wallpaper along with a set of command line arguments, returns a gradation
 // function. If the given arguments are invalid for whatever reason, the
@@ -139,17 +224,101 @@ func (w wallpaper) At(x, y int) color.Color {
 	return w.color(w.gradation(x, y))
 }
 
-// continuousColor returns a continuous color function, mapping gradation values
-// evenly between the two given colors.
-func continousColor(c1, c2 color.Color) func(float64) color.Color {
-	return func(grad float64) color.Color {
-		return gradate(c1, c2, grad)
+// gradientStop is one color of a multi-stop gradient, along with its
+// position in [0, 1].
+type gradientStop struct {
+	pos   float64
+	color color.Color
+}
+
+// chooseStops selects n stops (or 2, if n < 2) from the given palette
+// entries to interpolate across. Entries with an explicit stop position
+// (from a "stop=..." palette line) use it; the rest are assigned positions
+// evenly spaced across [0, 1] in selection order. If the palette has more
+// entries than n, the extra entries are dropped at random; entries with an
+// explicit stop are always kept.
+func chooseStops(entries []paletteEntry, n int) []gradientStop {
+	if n < 2 {
+		n = 2
+	}
+
+	chosen := make([]paletteEntry, 0, len(entries))
+	var rest []paletteEntry
+	for _, e := range entries {
+		if e.stop >= 0 {
+			chosen = append(chosen, e)
+		} else {
+			rest = append(rest, e)
+		}
+	}
+	for len(chosen) < n && len(rest) > 0 {
+		i := rand.Intn(len(rest))
+		chosen = append(chosen, rest[i])
+		rest = append(rest[:i], rest[i+1:]...)
+	}
+
+	result := make([]gradientStop, len(chosen))
+	for i, e := range chosen {
+		pos := 0.0
+		if len(chosen) > 1 {
+			pos = float64(i) / float64(len(chosen)-1)
+		}
+		if e.stop >= 0 {
+			pos = e.stop
+		}
+		result[i] = gradientStop{pos: pos, color: e.color}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].pos < result[j].pos })
+	return result
+}
+
+// continousColor returns a continuous color function built from the given
+// gradient stops (assigning any value outside their range to the nearest
+// end), binary-searching for the bracketing pair of stops and using
+// gradate to interpolate between them.
+func continousColor(stops []gradientStop) func(float64) color.Color {
+	return func(value float64) color.Color {
+		i := sort.Search(len(stops), func(i int) bool { return stops[i].pos >= value })
+		switch {
+		case i <= 0:
+			return stops[0].color
+		case i >= len(stops):
+			return stops[len(stops)-1].color
+		default:
+			lo, hi := stops[i-1], stops[i]
+			t := 0.0
+			if span := hi.pos - lo.pos; span > 0 {
+				t = (value - lo.pos) / span
+			}
+			return gradate(lo.color, hi.color, t)
+		}
 	}
 }
 
 // discreteColor returns a discrete color function, mapping gradation values as
-// in continousColor but only returning colors in the given slice.
+// in continousColor but only returning colors in the given slice. The
+// distance metric used to find the closest palette color is chosen by
+// *metric; for "cielab" the palette's Lab coordinates are precomputed once
+// here, since converting every palette color to Lab on every pixel is a
+// measurable hot spot.
 func discreteColor(c1, c2 color.Color, colors []color.Color) func(float64) color.Color {
+	if *metric == "cielab" {
+		labs := make([]lab, len(colors))
+		for i, c := range colors {
+			labs[i] = srgbToLab(c)
+		}
+		return func(grad float64) color.Color {
+			target := srgbToLab(gradate(c1, c2, grad))
+			best := 0
+			bestD := labDistanceSq(target, labs[0])
+			for i := 1; i < len(labs); i++ {
+				if d := labDistanceSq(target, labs[i]); d < bestD {
+					best, bestD = i, d
+				}
+			}
+			return colors[best]
+		}
+	}
 	return func(grad float64) color.Color {
 		return closest(gradate(c1, c2, grad), colors)
 	}
@@ -173,8 +342,23 @@ func closest(c color.Color, colors []color.Color) color.Color {
 	return close
 }
 
-// distance returns a measure of how "far away" two colors are.
+// distance returns a measure of how "far away" two colors are, according to
+// the metric named by *metric.
 func distance(c1, c2 color.Color) float64 {
+	switch *metric {
+	case "weighted":
+		return distanceWeighted(c1, c2)
+	case "cielab":
+		return labDistanceSq(srgbToLab(c1), srgbToLab(c2))
+	default:
+		return distanceRGB(c1, c2)
+	}
+}
+
+// distanceRGB is squared Euclidean distance in sRGB space. It is fast but
+// mismatches how humans perceive color closeness (greens dominate), so a
+// palette of pastels can end up collapsing to two colors on a gradient.
+func distanceRGB(c1, c2 color.Color) float64 {
 	r1, g1, b1, _ := c1.RGBA()
 	r2, g2, b2, _ := c2.RGBA()
 	dr := float64(r2) - float64(r1)
@@ -183,9 +367,40 @@ func distance(c1, c2 color.Color) float64 {
 	return dr*dr + dg*dg + db*db
 }
 
+// distanceWeighted is the "redmean" weighted Euclidean distance, a
+// cheap-to-compute approximation of perceptual color difference that
+// weights each channel by how sensitive human vision is to it in the
+// neighborhood of the two colors being compared.
+func distanceWeighted(c1, c2 color.Color) float64 {
+	r1, g1, b1, _ := c1.RGBA()
+	r2, g2, b2, _ := c2.RGBA()
+	rmean := (float64(r1) + float64(r2)) / 2 / 65535
+	dr := float64(r2) - float64(r1)
+	dg := float64(g2) - float64(g1)
+	db := float64(b2) - float64(b1)
+	return (2+rmean)*dr*dr + 4*dg*dg + (3-rmean)*db*db
+}
+
 // gradate returns a color "between" c1 and c2, with a value of 0 being c1
-// exactly and a value of 1 being c2 exactly.
+// exactly and a value of 1 being c2 exactly. The interpolation is done in
+// the colorspace named by *colorspace.
 func gradate(c1, c2 color.Color, value float64) color.Color {
+	switch *colorspace {
+	case "linear":
+		return gradateLinear(c1, c2, value)
+	case "oklab":
+		return gradateOklab(c1, c2, value)
+	default:
+		return gradateSRGB(c1, c2, value)
+	}
+}
+
+// gradateSRGB interpolates directly in (8-bit) sRGB space. This is the
+// original behavior of gradate; it is kept around as the "srgb"
+// colorspace for backward compatibility, even though it truncates each
+// channel to 0 or 1 before interpolating and so produces muddy,
+// banded-looking midtones.
+func gradateSRGB(c1, c2 color.Color, value float64) color.Color {
 	r1, g1, b1, _ := c1.RGBA()
 	r2, g2, b2, _ := c2.RGBA()
 	rf1, gf1, bf1 := float64(r1/255), float64(g1/255), float64(b1/255)
@@ -196,6 +411,163 @@ func gradate(c1, c2 color.Color, value float64) color.Color {
 	return color.RGBA{r, g, b, 255}
 }
 
+// gradateLinear interpolates in linear light, converting each channel
+// from sRGB to linear, lerping, and converting back. This avoids the
+// muddy midtones produced by interpolating directly in sRGB space.
+func gradateLinear(c1, c2 color.Color, value float64) color.Color {
+	r1, g1, b1 := srgbChannels(c1)
+	r2, g2, b2 := srgbChannels(c2)
+	r := srgbToLinear(r1) + (srgbToLinear(r2)-srgbToLinear(r1))*value
+	g := srgbToLinear(g1) + (srgbToLinear(g2)-srgbToLinear(g1))*value
+	b := srgbToLinear(b1) + (srgbToLinear(b2)-srgbToLinear(b1))*value
+	return color.RGBA{
+		floatToByte(linearToSRGB(r)),
+		floatToByte(linearToSRGB(g)),
+		floatToByte(linearToSRGB(b)),
+		255,
+	}
+}
+
+// gradateOklab interpolates in the Oklab perceptual colorspace, which
+// tends to give the smoothest-looking ramps since equal steps in Oklab
+// correspond roughly to equal steps in perceived color.
+func gradateOklab(c1, c2 color.Color, value float64) color.Color {
+	lab1 := srgbToOklab(c1)
+	lab2 := srgbToOklab(c2)
+	lab := oklab{
+		l: lab1.l + (lab2.l-lab1.l)*value,
+		a: lab1.a + (lab2.a-lab1.a)*value,
+		b: lab1.b + (lab2.b-lab1.b)*value,
+	}
+	return oklabToSRGB(lab)
+}
+
+// srgbChannels returns the red, green and blue channels of c, normalized
+// to the range [0, 1].
+func srgbChannels(c color.Color) (r, g, b float64) {
+	r16, g16, b16, _ := c.RGBA()
+	return float64(r16) / 65535, float64(g16) / 65535, float64(b16) / 65535
+}
+
+// floatToByte converts a normalized [0, 1] channel value to an 8-bit
+// channel value, clamping out-of-range input.
+func floatToByte(c float64) uint8 {
+	switch {
+	case c <= 0:
+		return 0
+	case c >= 1:
+		return 255
+	default:
+		return uint8(c*255 + 0.5)
+	}
+}
+
+// srgbToLinear converts a single normalized [0, 1] sRGB channel value to
+// linear light.
+func srgbToLinear(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB is the inverse of srgbToLinear.
+func linearToSRGB(c float64) float64 {
+	if c <= 0.0031308 {
+		return c * 12.92
+	}
+	return 1.055*math.Pow(c, 1/2.4) - 0.055
+}
+
+// oklab holds the coordinates of a color in the Oklab colorspace, as
+// described in https://bottosson.github.io/posts/oklab/.
+type oklab struct {
+	l, a, b float64
+}
+
+// srgbToOklab converts an sRGB color to Oklab.
+func srgbToOklab(c color.Color) oklab {
+	r, g, b := srgbChannels(c)
+	r, g, b = srgbToLinear(r), srgbToLinear(g), srgbToLinear(b)
+
+	l := 0.4122214708*r + 0.5363325363*g + 0.0514459929*b
+	m := 0.2119034982*r + 0.6806995451*g + 0.1073969566*b
+	s := 0.0883024619*r + 0.2817188376*g + 0.6299787005*b
+
+	l, m, s = math.Cbrt(l), math.Cbrt(m), math.Cbrt(s)
+
+	return oklab{
+		l: 0.2104542553*l + 0.7936177850*m - 0.0040720468*s,
+		a: 1.9779984951*l - 2.4285922050*m + 0.4505937099*s,
+		b: 0.0259040371*l + 0.7827717662*m - 0.8086757660*s,
+	}
+}
+
+// lab holds the coordinates of a color in CIE L*a*b* space (D65 white
+// point).
+type lab struct {
+	l, a, b float64
+}
+
+// srgbToLab converts an sRGB color to CIE L*a*b*, via linear RGB and the
+// CIE XYZ (D65) colorspace.
+func srgbToLab(c color.Color) lab {
+	r, g, b := srgbChannels(c)
+	r, g, b = srgbToLinear(r), srgbToLinear(g), srgbToLinear(b)
+
+	x := 0.4124564*r + 0.3575761*g + 0.1804375*b
+	y := 0.2126729*r + 0.7151522*g + 0.0721750*b
+	z := 0.0193339*r + 0.1191920*g + 0.9503041*b
+
+	const xn, yn, zn = 0.95047, 1.0, 1.08883
+	fx, fy, fz := labF(x/xn), labF(y/yn), labF(z/zn)
+
+	return lab{
+		l: 116*fy - 16,
+		a: 500 * (fx - fy),
+		b: 200 * (fy - fz),
+	}
+}
+
+// labF is the nonlinear function used when converting CIE XYZ to L*a*b*.
+func labF(t float64) float64 {
+	const delta = 6.0 / 29.0
+	if t > delta*delta*delta {
+		return math.Cbrt(t)
+	}
+	return t/(3*delta*delta) + 4.0/29.0
+}
+
+// labDistanceSq returns the squared CIE76 color difference (ΔE*76) between
+// two Lab colors.
+func labDistanceSq(c1, c2 lab) float64 {
+	dl := c1.l - c2.l
+	da := c1.a - c2.a
+	db := c1.b - c2.b
+	return dl*dl + da*da + db*db
+}
+
+// oklabToSRGB converts an Oklab color back to sRGB, clamping out-of-gamut
+// results.
+func oklabToSRGB(c oklab) color.Color {
+	l := c.l + 0.3963377774*c.a + 0.2158037573*c.b
+	m := c.l - 0.1055613458*c.a - 0.0638541728*c.b
+	s := c.l - 0.0894841775*c.a - 1.2914855480*c.b
+
+	l, m, s = l*l*l, m*m*m, s*s*s
+
+	r := 4.0767416621*l - 3.3077115913*m + 0.2309699292*s
+	g := -1.2684380046*l + 2.6097574011*m - 0.3413193965*s
+	b := -0.0041960863*l - 0.7034186147*m + 1.7076147010*s
+
+	return color.RGBA{
+		floatToByte(linearToSRGB(r)),
+		floatToByte(linearToSRGB(g)),
+		floatToByte(linearToSRGB(b)),
+		255,
+	}
+}
+
 // chooseTwo chooses two colors at random from the given slice. It panics if
 // there are fewer than two colors provided.
 func chooseTwo(colors []color.Color) (color.Color, color.Color) {
@@ -210,25 +582,74 @@ func chooseTwo(colors []color.Color) (color.Color, color.Color) {
 	return colors[i1], colors[i2]
 }
 
-var colorRegexp = regexp.MustCompile("^#([A-Fa-f0-9]{2})([A-Fa-f0-9]{2})([A-Fa-f0-9]{2})$")
+// paletteEntry is one line of palette input: a color along with optional
+// metadata (a name and/or an explicit gradient stop position) used when
+// building multi-stop gradients.
+type paletteEntry struct {
+	name  string  // optional, empty if not given
+	stop  float64 // explicit stop position in [0, 1], or -1 if not given
+	color color.Color
+}
+
+var hexColorRegexp = regexp.MustCompile("^#([A-Fa-f0-9]{2})([A-Fa-f0-9]{2})([A-Fa-f0-9]{2})([A-Fa-f0-9]{2})?$")
 
-// readColors reads a color from each line of the given reader, returning a slice
-// of all the colors found (or an error if one or more lines is not a color).
-func readColors(r io.Reader) ([]color.Color, error) {
-	var colors []color.Color
+// readColors reads a palette entry from each line of the given reader,
+// returning a slice of all the entries found (or an error if one or more
+// lines is invalid). Each line may be a plain "#RRGGBB" or "#RRGGBBAA"
+// color, a named color ("name #RRGGBB"), or an explicit gradient stop
+// ("stop=0.35 #RRGGBB").
+func readColors(r io.Reader) ([]paletteEntry, error) {
+	var entries []paletteEntry
 	s := bufio.NewScanner(r)
 	for s.Scan() {
-		if match := colorRegexp.FindStringSubmatch(s.Text()); match != nil {
-			r, _ := strconv.ParseUint(match[1], 16, 8)
-			g, _ := strconv.ParseUint(match[2], 16, 8)
-			b, _ := strconv.ParseUint(match[3], 16, 8)
-			colors = append(colors, color.RGBA{uint8(r), uint8(g), uint8(b), 255})
-		} else {
-			return nil, fmt.Errorf("not a color: %v", s.Text())
+		entry, err := parsePaletteLine(s.Text())
+		if err != nil {
+			return nil, err
 		}
+		entries = append(entries, entry)
 	}
 	if err := s.Err(); err != nil {
 		return nil, err
 	}
-	return colors, nil
+	return entries, nil
+}
+
+// parsePaletteLine parses a single line of palette input into a
+// paletteEntry.
+func parsePaletteLine(line string) (paletteEntry, error) {
+	entry := paletteEntry{stop: -1}
+
+	fields := strings.Fields(line)
+	var colorField string
+	switch len(fields) {
+	case 1:
+		colorField = fields[0]
+	case 2:
+		colorField = fields[1]
+		if stopStr, ok := strings.CutPrefix(fields[0], "stop="); ok {
+			stop, err := strconv.ParseFloat(stopStr, 64)
+			if err != nil {
+				return entry, fmt.Errorf("not a color: %v: invalid stop: %v", line, err)
+			}
+			entry.stop = stop
+		} else {
+			entry.name = fields[0]
+		}
+	default:
+		return entry, fmt.Errorf("not a color: %v", line)
+	}
+
+	match := hexColorRegexp.FindStringSubmatch(colorField)
+	if match == nil {
+		return entry, fmt.Errorf("not a color: %v", line)
+	}
+	r, _ := strconv.ParseUint(match[1], 16, 8)
+	g, _ := strconv.ParseUint(match[2], 16, 8)
+	b, _ := strconv.ParseUint(match[3], 16, 8)
+	a := uint64(255)
+	if match[4] != "" {
+		a, _ = strconv.ParseUint(match[4], 16, 8)
+	}
+	entry.color = color.RGBA{uint8(r), uint8(g), uint8(b), uint8(a)}
+	return entry, nil
 }